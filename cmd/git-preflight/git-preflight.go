@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path"
+	"regexp"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/msolo/cmdflag"
 	"github.com/msolo/git-mg/gitapi"
@@ -17,7 +22,17 @@ import (
 )
 
 const (
+	// InputTypeArgs appends the matched files as trailing arguments to Cmd.
 	InputTypeArgs = "args"
+	// InputTypeStdin writes a newline-delimited list of matched files to
+	// the command's stdin, leaving Cmd untouched.
+	InputTypeStdin = "stdin"
+	// InputTypeArgfile writes a newline-delimited list of matched files to
+	// a temp file and substitutes its path for a "{argfile}" placeholder
+	// in Cmd.
+	InputTypeArgfile = "argfile"
+
+	argfilePlaceholder = "{argfile}"
 )
 
 // Define a command that will be executed when a relevant file changed.
@@ -28,13 +43,47 @@ type TriggerConfig struct {
 	InputType string
 	Includes  []string
 	Excludes  []string
+	// Patterns is an ordered list of gitignore-style rules, evaluated as a
+	// single list where the last matching rule decides inclusion: a bare
+	// rule selects a path, and a rule prefixed with "!" excludes a path
+	// an earlier rule selected. No path is selected by default. When set,
+	// Patterns takes precedence over Includes/Excludes, which are kept
+	// only for backward compatibility.
+	Patterns []string
+	// compiledPatterns holds Patterns compiled to regexps at load time.
+	compiledPatterns []compiledPattern
+	// DependsOn names other triggers that must finish before this one starts.
+	DependsOn []string
+	// Serial forces this trigger to run by itself: it waits for every
+	// previously started trigger to finish, runs alone, and blocks any
+	// later trigger from starting until it completes.
+	Serial bool
+	// Batch chunks matched files into multiple invocations of at most
+	// Batch files each, mirroring xargs -n. Zero (the default) runs all
+	// matched files through a single invocation.
+	Batch int
+	// Hooks lists the git hook stages ("pre-commit", "pre-push",
+	// "commit-msg") that run this trigger when installed via
+	// `git preflight install`. A trigger with no Hooks only runs via an
+	// explicit `git preflight run`.
+	Hooks []string
+}
+
+// validHookNames are the git hook stages git-preflight knows how to
+// install and filter triggers by.
+var validHookNames = map[string]bool{
+	"pre-commit": true,
+	"pre-push":   true,
+	"commit-msg": true,
 }
 
 // Config global include/exclude rules
 type PreflightConfig struct {
 	// Triggers are executed in order.
-	// FIXME(msolo) specify how to run them in parallel? Or just rely on shell scripts underneath?
 	Triggers []TriggerConfig
+	// Parallelism bounds how many non-serial triggers run concurrently.
+	// A value <= 1 runs triggers one at a time. The -j flag overrides this.
+	Parallelism int
 }
 
 func readConfig(fname string) (*PreflightConfig, error) {
@@ -57,19 +106,146 @@ func readConfig(fname string) (*PreflightConfig, error) {
 
 func validateConfig(cfg *PreflightConfig) error {
 	nameMap := make(map[string]bool)
-	for _, t := range cfg.Triggers {
+	for i := range cfg.Triggers {
+		t := &cfg.Triggers[i]
 		if exists := nameMap[t.Name]; exists {
 			return fmt.Errorf("duplicate trigger name: %s", t.Name)
 		} else {
 			nameMap[t.Name] = true
 		}
-		if err := validateTrigger(&t); err != nil {
+		if err := validateTrigger(t); err != nil {
 			return err
 		}
 	}
+	for _, t := range cfg.Triggers {
+		for _, dep := range t.DependsOn {
+			if !nameMap[dep] {
+				return fmt.Errorf("trigger %s depends on unknown trigger %q", t.Name, dep)
+			}
+		}
+	}
+	if _, err := topoLevels(cfg.Triggers); err != nil {
+		return err
+	}
 	return nil
 }
 
+// topoLevels groups triggers into dependency levels using Kahn's algorithm:
+// level 0 has no dependencies (within the given set of triggers), level 1
+// depends only on names in level 0, and so on. Dependencies on a trigger
+// that is not in the given set are considered already satisfied, so callers
+// can run topoLevels over a filtered subset of enabled/matched triggers.
+// Returns an error if DependsOn forms a cycle.
+func topoLevels(triggers []TriggerConfig) ([][]string, error) {
+	names := make(map[string]bool, len(triggers))
+	for _, t := range triggers {
+		names[t.Name] = true
+	}
+	deps := make(map[string][]string, len(triggers))
+	for _, t := range triggers {
+		for _, d := range t.DependsOn {
+			if names[d] {
+				deps[t.Name] = append(deps[t.Name], d)
+			}
+		}
+	}
+
+	done := make(map[string]bool, len(triggers))
+	var levels [][]string
+	for len(done) < len(triggers) {
+		var level []string
+		for _, t := range triggers {
+			if done[t.Name] {
+				continue
+			}
+			ready := true
+			for _, d := range deps[t.Name] {
+				if !done[d] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				level = append(level, t.Name)
+			}
+		}
+		if len(level) == 0 {
+			return nil, fmt.Errorf("cycle detected in trigger DependsOn")
+		}
+		for _, name := range level {
+			done[name] = true
+		}
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
+
+// triggerJob is a trigger enabled for this run, paired with the files it
+// matched and those files batched per tr.Batch.
+type triggerJob struct {
+	tr      *TriggerConfig
+	fnames  []string
+	batches [][]string
+}
+
+// runLevels walks levels in order, running each level's triggers in
+// declared order: consecutive non-serial triggers run concurrently
+// (bounded by parallelism), while a Serial trigger is a barrier that waits
+// for the concurrent run ahead of it to finish, runs alone via runOne, and
+// only then lets any later trigger in the level start. After each serial
+// trigger or concurrent group completes, flush is called with the names
+// that just finished, in the order they appear in the level. Walking stops
+// as soon as ctx is done, or after a group/serial trigger completes if
+// ctx is done and failFast is set.
+func runLevels(ctx context.Context, levels [][]string, jobsByName map[string]*triggerJob, parallelism int, failFast bool, runOne func(*triggerJob), flush func([]string)) {
+levelLoop:
+	for _, level := range levels {
+		i := 0
+		for i < len(level) {
+			if ctx.Err() != nil {
+				break levelLoop
+			}
+
+			if jobsByName[level[i]].tr.Serial {
+				name := level[i]
+				runOne(jobsByName[name])
+				flush([]string{name})
+				i++
+				continue
+			}
+
+			j := i
+			for j < len(level) && !jobsByName[level[j]].tr.Serial {
+				j++
+			}
+			group := level[i:j]
+
+			sem := make(chan struct{}, parallelism)
+			var wg sync.WaitGroup
+			for _, name := range group {
+				if ctx.Err() != nil {
+					break
+				}
+				sem <- struct{}{}
+				wg.Add(1)
+				job := jobsByName[name]
+				go func() {
+					defer wg.Done()
+					defer func() { <-sem }()
+					runOne(job)
+				}()
+			}
+			wg.Wait()
+			flush(group)
+
+			if failFast && ctx.Err() != nil {
+				break levelLoop
+			}
+			i = j
+		}
+	}
+}
+
 func validateTrigger(tr *TriggerConfig) error {
 	// NOTE: Multiple keys with the same name is not an error in JSON, last value wins.
 	if tr.Name == "" {
@@ -79,10 +255,29 @@ func validateTrigger(tr *TriggerConfig) error {
 	}
 
 	switch tr.InputType {
-	case "args":
+	case InputTypeArgs, InputTypeStdin:
+	case InputTypeArgfile:
+		hasPlaceholder := false
+		for _, a := range tr.Cmd {
+			if strings.Contains(a, argfilePlaceholder) {
+				hasPlaceholder = true
+				break
+			}
+		}
+		if !hasPlaceholder {
+			return fmt.Errorf("trigger %s has input type %s but no %s placeholder in Cmd", tr.Name, InputTypeArgfile, argfilePlaceholder)
+		}
 	default:
 		return fmt.Errorf("invalid trigger input type %q for trigger %s", tr.InputType, tr.Name)
 	}
+	if tr.Batch < 0 {
+		return fmt.Errorf("invalid negative batch size for trigger %s", tr.Name)
+	}
+	for _, h := range tr.Hooks {
+		if !validHookNames[h] {
+			return fmt.Errorf("invalid hook %q for trigger %s", h, tr.Name)
+		}
+	}
 	for _, pat := range tr.Includes {
 		if _, err := path.Match(pat, ""); err != nil {
 			return fmt.Errorf("invalid include pattern %q for trigger %s: %v", pat, tr.Name, err)
@@ -94,14 +289,132 @@ func validateTrigger(tr *TriggerConfig) error {
 			return fmt.Errorf("invalid exclude pattern %q for trigger %s: %v", pat, tr.Name, err)
 		}
 	}
+
+	if len(tr.Patterns) > 0 {
+		compiled := make([]compiledPattern, 0, len(tr.Patterns))
+		for _, pat := range tr.Patterns {
+			cp, err := compilePattern(pat)
+			if err != nil {
+				return fmt.Errorf("invalid pattern %q for trigger %s: %v", pat, tr.Name, err)
+			}
+			compiled = append(compiled, cp)
+		}
+		tr.compiledPatterns = compiled
+	}
 	return nil
 }
 
-// Match is similar to fnmatch.
-// Patterns containing no / are only matched against the basename, unlike path.Match.
-// Includes are applied first and then filtered by excludes.
-// FIXME(msolo) Incorporate ideas from gitignore style matching like ** and ! ?
+// compiledPattern is a single gitignore-style rule compiled to a regexp
+// that matches a repo-relative file path.
+type compiledPattern struct {
+	negate bool
+	re     *regexp.Regexp
+}
+
+// compilePattern compiles a single gitignore-style pattern line. It
+// supports "**" matching zero or more path segments, "*"/"?" never
+// crossing "/", a leading "/" anchoring to the repo root, a trailing "/"
+// restricting the rule to paths inside a directory, and a leading "!"
+// negating the rule, so a path it matches is excluded.
+func compilePattern(pattern string) (compiledPattern, error) {
+	negate := strings.HasPrefix(pattern, "!")
+	if negate {
+		pattern = pattern[1:]
+	}
+
+	anchored := strings.HasPrefix(pattern, "/")
+	if anchored {
+		pattern = pattern[1:]
+	}
+
+	dirOnly := strings.HasSuffix(pattern, "/")
+	if dirOnly {
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+
+	if pattern == "" {
+		return compiledPattern{}, fmt.Errorf("empty pattern")
+	}
+
+	// A "/" anywhere but the very end anchors the pattern to the repo
+	// root, matching .gitignore semantics.
+	if strings.Contains(pattern, "/") {
+		anchored = true
+	}
+
+	reStr := "^"
+	if !anchored {
+		reStr += "(?:.*/)?"
+	}
+	reStr += gitignoreBodyToRegexp(pattern)
+	if dirOnly {
+		reStr += "/.+$"
+	} else {
+		reStr += "$"
+	}
+
+	re, err := regexp.Compile(reStr)
+	if err != nil {
+		return compiledPattern{}, err
+	}
+	return compiledPattern{negate: negate, re: re}, nil
+}
+
+// gitignoreBodyToRegexp translates the glob body of a gitignore-style
+// pattern (with anchoring slashes already stripped) into a regexp
+// fragment. "**/" and "/**" consume zero or more whole path segments, a
+// bare "**" matches anything, "*" and "?" never cross "/", and all other
+// characters are matched literally.
+func gitignoreBodyToRegexp(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); {
+		rest := pattern[i:]
+		switch {
+		case strings.HasPrefix(rest, "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 3
+		case strings.HasPrefix(rest, "/**"):
+			b.WriteString("(?:/.*)?")
+			i += 3
+		case rest == "**":
+			b.WriteString(".*")
+			i += 2
+		case pattern[i] == '*':
+			b.WriteString("[^/]*")
+			i++
+		case pattern[i] == '?':
+			b.WriteString("[^/]")
+			i++
+		default:
+			b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			i++
+		}
+	}
+	return b.String()
+}
+
+// match reports whether fname is selected by trigger tr.
+//
+// When tr.Patterns is set, rules are evaluated in the order given as a
+// single gitignore-style list: the last matching rule wins, so a "!"
+// pattern excludes a path an earlier rule selected. No path is selected
+// by default.
+//
+// Otherwise match falls back to the legacy Includes/Excludes fields,
+// fnmatch-style via path.Match. Patterns containing no / are only matched
+// against the basename, unlike path.Match. Includes are applied first and
+// then filtered by excludes.
 func match(tr *TriggerConfig, fname string) (bool, error) {
+	if len(tr.compiledPatterns) > 0 {
+		included := false
+		for _, p := range tr.compiledPatterns {
+			if p.re.MatchString(fname) {
+				included = !p.negate
+			}
+		}
+		return included, nil
+	}
+
 	for _, pat := range tr.Includes {
 		matchName := fname
 		if !strings.Contains(pat, "/") {
@@ -130,29 +443,198 @@ func match(tr *TriggerConfig, fname string) (bool, error) {
 	return false, nil
 }
 
-func exitOnError(err error) {
-	if err != nil {
-		// log.Fatal and glug.Exit are about the same. glug.Fatal has a lot of stack litter.
-		glug.Exit(err)
+// zeroSha is the all-zero object ID git uses on the pre-push hook's stdin
+// to mean "this ref doesn't exist" (a new ref being pushed, or one being
+// deleted).
+const zeroSha = "0000000000000000000000000000000000000000"
+
+// emptyTreeSha is git's well-known hash for an empty tree object, present
+// in every repository. Diffing against it yields every file in the other
+// side's tree, which is used as the base for a brand-new ref's pre-push
+// scan so a multi-commit stack isn't reduced to just its tip commit.
+const emptyTreeSha = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// renameLines formats the rename/copy pairs in files as sorted "old -> new"
+// strings, for surfacing moved files in verbose/log output.
+func renameLines(files []gitapi.FileChange) []string {
+	var lines []string
+	for _, f := range files {
+		if f.OldName != "" {
+			lines = append(lines, fmt.Sprintf("%s -> %s", f.OldName, f.Name))
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// resolvePrePushChanges reads the "<local ref> <local sha> <remote ref>
+// <remote sha>" lines git writes to a pre-push hook's stdin and resolves
+// the union of changed files and directories, and rename/copy pairs,
+// across every updated ref.
+func resolvePrePushChanges(workdir string, stdin io.Reader) ([]string, []string, []string, error) {
+	fileSet := make(map[string]bool)
+	dirSet := make(map[string]bool)
+	renameSet := make(map[string]bool)
+
+	sc := bufio.NewScanner(stdin)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			return nil, nil, nil, fmt.Errorf("malformed pre-push ref line: %q", line)
+		}
+		localSha, remoteSha := fields[1], fields[3]
+		if localSha == zeroSha {
+			continue // the ref is being deleted; nothing to check.
+		}
+
+		rev := remoteSha + ".." + localSha
+		if remoteSha == zeroSha {
+			// A brand new ref: there's no remote commit to diff against,
+			// so diff from the empty tree to cover every file the new
+			// ref introduces, not just its tip commit.
+			rev = emptyTreeSha + ".." + localSha
+		}
+
+		cs, err := gitapi.ResolveChanges(workdir, gitapi.ChangeSpec{Rev: rev})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, name := range cs.FileNames() {
+			fileSet[name] = true
+		}
+		for _, d := range cs.Dirs {
+			dirSet[d] = true
+		}
+		for _, line := range renameLines(cs.Files) {
+			renameSet[line] = true
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	changedFiles := make([]string, 0, len(fileSet))
+	for name := range fileSet {
+		changedFiles = append(changedFiles, name)
+	}
+	sort.Strings(changedFiles)
+
+	changedDirs := make([]string, 0, len(dirSet))
+	for d := range dirSet {
+		changedDirs = append(changedDirs, d)
+	}
+	sort.Strings(changedDirs)
+
+	renames := make([]string, 0, len(renameSet))
+	for line := range renameSet {
+		renames = append(renames, line)
+	}
+	sort.Strings(renames)
+
+	return changedFiles, changedDirs, renames, nil
+}
+
+// batchFnames splits fnames into chunks of at most batch entries each,
+// mirroring xargs -n. A non-positive batch (or one at least as large as
+// fnames) runs everything through a single chunk.
+func batchFnames(fnames []string, batch int) [][]string {
+	if batch <= 0 || batch >= len(fnames) {
+		return [][]string{fnames}
+	}
+	batches := make([][]string, 0, (len(fnames)+batch-1)/batch)
+	for i := 0; i < len(fnames); i += batch {
+		end := i + batch
+		if end > len(fnames) {
+			end = len(fnames)
+		}
+		batches = append(batches, fnames[i:end])
 	}
+	return batches
 }
 
-func isDir(fname string) bool {
-	fi, err := os.Stat(fname)
+// runBatch executes tr's command once against a single batch of matched
+// files, routing the files according to tr.InputType, and appends the
+// command's combined stdout/stderr to out.
+func runBatch(ctx context.Context, workdir string, tr *TriggerConfig, batch []string, out *bytes.Buffer) error {
+	var cmdArgs []string
+	var stdin io.Reader
+
+	switch tr.InputType {
+	case InputTypeArgs:
+		cmdArgs = make([]string, 0, len(tr.Cmd)+len(batch))
+		cmdArgs = append(cmdArgs, tr.Cmd...)
+		cmdArgs = append(cmdArgs, batch...)
+	case InputTypeStdin:
+		cmdArgs = append([]string{}, tr.Cmd...)
+		stdin = strings.NewReader(strings.Join(batch, "\n") + "\n")
+	case InputTypeArgfile:
+		f, err := os.CreateTemp("", "git-preflight-argfile-")
+		if err != nil {
+			return fmt.Errorf("creating argfile: %w", err)
+		}
+		defer os.Remove(f.Name())
+		_, werr := f.WriteString(strings.Join(batch, "\n") + "\n")
+		cerr := f.Close()
+		if werr != nil {
+			return fmt.Errorf("writing argfile: %w", werr)
+		}
+		if cerr != nil {
+			return fmt.Errorf("closing argfile: %w", cerr)
+		}
+		cmdArgs = make([]string, 0, len(tr.Cmd))
+		for _, a := range tr.Cmd {
+			cmdArgs = append(cmdArgs, strings.ReplaceAll(a, argfilePlaceholder, f.Name()))
+		}
+	default:
+		return fmt.Errorf("invalid input type %q for trigger %q", tr.InputType, tr.Name)
+	}
+
+	c := exec.CommandContext(ctx, cmdArgs[0], cmdArgs[1:]...)
+	c.Dir = workdir
+	c.Stdout = out
+	c.Stderr = out
+	if stdin != nil {
+		c.Stdin = stdin
+	}
+	return c.Run()
+}
+
+func exitOnError(err error) {
 	if err != nil {
-		return false
+		// log.Fatal and glug.Exit are about the same. glug.Fatal has a lot of stack litter.
+		glug.Exit(err)
 	}
-	return fi.IsDir()
 }
 
 func runPreflight(ctx context.Context, cmd *cmdflag.Command, args []string) {
 	var dryRun bool
 	var verbose bool
 	var commitHash string
+	var rev string
+	var hookName string
+	var parallelism int
+	var failFast bool
 	fs := cmd.BindFlagSet(map[string]interface{}{
 		"commit-hash": &commitHash,
+		"rev":         &rev,
 		"dry-run":     &dryRun,
-		"v": &verbose,
+		"v":           &verbose,
+		"j":           &parallelism,
+		"fail-fast":   &failFast,
+		"hook":        &hookName,
 	})
 	fs.Parse(args)
 	triggerNames := fs.Args()
@@ -166,50 +648,65 @@ func runPreflight(ctx context.Context, cmd *cmdflag.Command, args []string) {
 	cfg, err := readConfig(path.Join(gitWorkdir, ".git-preflight"))
 	exitOnError(err)
 
-	var changedFiles []string
-	if commitHash != "" {
-		changedFiles, err = gitapi.GetGitCommitChanges(gitWorkdir, commitHash)
-		exitOnError(err)
-	} else {
-		mergeBaseHash, err := gitapi.GetMergeBaseCommitHash(gitWorkdir)
-		exitOnError(err)
-		committedFiles, err := gitapi.GetGitDiffChanges(gitWorkdir, mergeBaseHash)
-		exitOnError(err)
-		unstagedFiles, err := gitapi.GetGitUnstagedChanges(gitWorkdir)
-		exitOnError(err)
-		stagedFiles, err := gitapi.GetGitStagedChanges(gitWorkdir)
-		exitOnError(err)
+	if parallelism <= 0 {
+		parallelism = cfg.Parallelism
+	}
+	if parallelism <= 0 {
+		parallelism = 1
+	}
 
-		changedFileSet := make(map[string]bool, 64)
-		for _, fnames := range [][]string{committedFiles, unstagedFiles, stagedFiles} {
-			for _, fname := range fnames {
-				changedFileSet[fname] = true
-			}
+	if commitHash != "" {
+		fmt.Fprintf(os.Stderr, "warning: -commit-hash is deprecated, use -rev instead\n")
+		if rev == "" {
+			rev = commitHash
 		}
-		changedFiles = stringSet2Slice(changedFileSet)
 	}
 
-	sort.Strings(changedFiles)
+	if hookName != "" && !validHookNames[hookName] {
+		exitOnError(fmt.Errorf("invalid hook %q", hookName))
+	}
 
-	changedDirSet := make(map[string]bool)
-	for _, f := range changedFiles {
-		dirName := path.Dir(f)
-		if isDir(dirName) {
-			changedDirSet[dirName] = true
+	var changedFiles []string
+	var changedDirs []string
+	var renames []string
+	if hookName == "pre-push" {
+		changedFiles, changedDirs, renames, err = resolvePrePushChanges(gitWorkdir, os.Stdin)
+		exitOnError(err)
+	} else {
+		spec := gitapi.ChangeSpec{Rev: rev}
+		if rev == "" {
+			spec.WorkingTree = true
 		}
+		changeSet, err := gitapi.ResolveChanges(gitWorkdir, spec)
+		exitOnError(err)
+		changedFiles = changeSet.FileNames()
+		changedDirs = changeSet.Dirs
+		renames = renameLines(changeSet.Files)
 	}
 
-	changedDirs := stringSet2Slice(changedDirSet)
-	sort.Strings(changedDirs)
-
 	glug.Infof("changedFiles: %s\n", strings.Join(changedFiles, ", "))
 	glug.Infof("changedDirs: %s\n", strings.Join(changedDirs, ", "))
+	if len(renames) > 0 {
+		glug.Infof("renames: %s\n", strings.Join(renames, ", "))
+	}
+
+	// Restrict the candidate triggers to the requested hook stage, if any.
+	candidateTriggers := cfg.Triggers
+	if hookName != "" {
+		candidateTriggers = nil
+		for _, tr := range cfg.Triggers {
+			if containsString(tr.Hooks, hookName) {
+				candidateTriggers = append(candidateTriggers, tr)
+			}
+		}
+	}
 
 	cfgTriggerMap := make(map[string]*TriggerConfig)
 
-	allTriggerNames := make([]string, 0, len(cfg.Triggers))
-	for _, tr := range cfg.Triggers {
-		cfgTriggerMap[tr.Name] = &tr
+	allTriggerNames := make([]string, 0, len(candidateTriggers))
+	for i := range candidateTriggers {
+		tr := &candidateTriggers[i]
+		cfgTriggerMap[tr.Name] = tr
 		allTriggerNames = append(allTriggerNames, tr.Name)
 	}
 
@@ -226,16 +723,19 @@ func runPreflight(ctx context.Context, cmd *cmdflag.Command, args []string) {
 		enabledTriggers[name] = true
 	}
 
-	hasError := false
-	// Iterate over triggers as configured to preserve execution order.
-	for _, tr := range cfg.Triggers {
+	// Iterate over triggers as configured to preserve execution order, and
+	// keep only those that are enabled and have at least one matched file.
+	runnable := make([]TriggerConfig, 0, len(candidateTriggers))
+	jobsByName := make(map[string]*triggerJob, len(candidateTriggers))
+	for i := range candidateTriggers {
+		tr := &candidateTriggers[i]
 		if !enabledTriggers[tr.Name] {
 			continue
 		}
 
 		fnames := make([]string, 0, len(changedFiles))
 		for _, fname := range changedFiles {
-			matched, err := match(&tr, fname)
+			matched, err := match(tr, fname)
 			if err != nil {
 				exitOnError(err)
 			}
@@ -247,44 +747,81 @@ func runPreflight(ctx context.Context, cmd *cmdflag.Command, args []string) {
 			continue
 		}
 
-		if verbose {
-			fmt.Fprintf(os.Stderr, "run trigger %s: %s\n", tr.Name, strings.Join(fnames, ", "))
+		batches := batchFnames(fnames, tr.Batch)
+
+		if dryRun {
+			fmt.Fprintf(os.Stderr, "would run trigger %s (%s, %d batch(es)): %s\n", tr.Name, tr.InputType, len(batches), strings.Join(fnames, ", "))
+			continue
 		}
 
-		cmdArgs := make([]string, 0, len(tr.Cmd))
-		cmdArgs = append(cmdArgs, tr.Cmd...)
-		if tr.InputType == "args" {
-			cmdArgs = append(cmdArgs, fnames...)
-		} else {
-			exitOnError(fmt.Errorf("invalid input type %q for trigger %q", tr.InputType, tr.Name))
+		runnable = append(runnable, *tr)
+		jobsByName[tr.Name] = &triggerJob{tr: tr, fnames: fnames, batches: batches}
+	}
+
+	if dryRun {
+		return
+	}
+
+	levels, err := topoLevels(runnable)
+	exitOnError(err)
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		hasError bool
+		errMu    sync.Mutex
+		outMu    sync.Mutex
+	)
+	outputs := make(map[string][]byte, len(jobsByName))
+
+	runOne := func(job *triggerJob) {
+		if verbose {
+			fmt.Fprintf(os.Stderr, "run trigger %s: %s\n", job.tr.Name, strings.Join(job.fnames, ", "))
 		}
 
-		if dryRun {
-			fmt.Fprintf(os.Stderr, "would run trigger %s: %s\n", tr.Name, strings.Join(gitapi.BashQuote(cmdArgs...), " "))
-			continue
+		var buf bytes.Buffer
+		failed := false
+		for _, batch := range job.batches {
+			if runCtx.Err() != nil {
+				break
+			}
+			if err := runBatch(runCtx, gitWorkdir, job.tr, batch, &buf); err != nil {
+				fmt.Fprintf(&buf, "%s: %s\n", job.tr.Name, err)
+				failed = true
+				if failFast {
+					break
+				}
+			}
 		}
 
-		cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
-		cmd.Dir = gitWorkdir
-		if err := cmd.Run(); err != nil {
+		outMu.Lock()
+		outputs[job.tr.Name] = buf.Bytes()
+		outMu.Unlock()
+
+		if failed {
+			errMu.Lock()
 			hasError = true
+			errMu.Unlock()
+			if failFast {
+				cancel()
+			}
 		}
 	}
 
-	if hasError {
-		os.Exit(1)
+	flush := func(names []string) {
+		outMu.Lock()
+		defer outMu.Unlock()
+		for _, name := range names {
+			os.Stdout.Write(outputs[name])
+		}
 	}
-}
 
-func stringSet2Slice(ss map[string]bool) []string {
-	if len(ss) == 0 {
-		return nil
-	}
-	sl := make([]string, 0, len(ss))
-	for x := range ss {
-		sl = append(sl, x)
+	runLevels(runCtx, levels, jobsByName, parallelism, failFast, runOne, flush)
+
+	if hasError {
+		os.Exit(1)
 	}
-	return sl
 }
 
 func runValidate(ctx context.Context, cmd *cmdflag.Command, args []string) {
@@ -330,8 +867,12 @@ var cmdRun = &cmdflag.Command{
 	Args: &predictTrigger{},
 	Flags: []cmdflag.Flag{
 		{"v", cmdflag.FlagTypeBool, false, "Increase logging", nil},
-		{"commit-hash", cmdflag.FlagTypeString, "", "Use a specific commit to generate a list of changed files.", nil},
+		{"commit-hash", cmdflag.FlagTypeString, "", "Deprecated, use -rev instead.", nil},
+		{"rev", cmdflag.FlagTypeString, "", "A commit, or a revision range (A..B or A...B), to generate a list of changed files. Defaults to the working tree: staged, unstaged and committed-since-merge-base changes.", nil},
 		{"dry-run", cmdflag.FlagTypeBool, false, "Log the triggers that would execute.", nil},
+		{"j", cmdflag.FlagTypeInt, 0, "Run up to N non-serial triggers concurrently. Overrides the config's Parallelism.", nil},
+		{"fail-fast", cmdflag.FlagTypeBool, false, "Cancel outstanding triggers as soon as one fails.", nil},
+		{"hook", cmdflag.FlagTypeString, "", "Restrict to triggers that opt into this hook stage (pre-commit, pre-push, commit-msg) via git preflight install.", nil},
 	},
 	UsageLine: `Run triggers.`,
 	UsageLong: `Run triggers.
@@ -350,6 +891,145 @@ var cmdValidate = &cmdflag.Command{
 `,
 }
 
+// managedHookNames are the git hook stages `install`/`uninstall` manage.
+var managedHookNames = []string{"pre-commit", "pre-push", "commit-msg"}
+
+// hookSentinel marks a hook script as owned by git-preflight, so install
+// is idempotent and uninstall knows it's safe to remove.
+const hookSentinel = "# managed-by git-preflight; re-run `git preflight install` to update."
+
+func runInstall(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	gitWorkdir := gitapi.GitWorkdir()
+	hooksDir := path.Join(gitWorkdir, ".git", "hooks")
+	for _, hook := range managedHookNames {
+		exitOnError(installHook(hooksDir, hook))
+	}
+}
+
+func runUninstall(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	gitWorkdir := gitapi.GitWorkdir()
+	hooksDir := path.Join(gitWorkdir, ".git", "hooks")
+	for _, hook := range managedHookNames {
+		exitOnError(uninstallHook(hooksDir, hook))
+	}
+}
+
+// installHook writes a managed hook script for the given stage, chaining
+// any pre-existing user hook at <hook>.local. Re-running install is
+// idempotent: a hook already managed by git-preflight is just rewritten.
+func installHook(hooksDir, hook string) error {
+	hookPath := path.Join(hooksDir, hook)
+	localPath := hookPath + ".local"
+
+	existing, err := os.ReadFile(hookPath)
+	switch {
+	case err == nil && !isManagedHook(existing):
+		if _, statErr := os.Stat(localPath); statErr == nil {
+			return fmt.Errorf("refusing to install %s hook: an unmanaged hook exists at %s and %s is already taken; move one aside and re-run install", hook, hookPath, localPath)
+		} else if !os.IsNotExist(statErr) {
+			return statErr
+		}
+		if err := os.Rename(hookPath, localPath); err != nil {
+			return err
+		}
+	case err != nil && !os.IsNotExist(err):
+		return err
+	}
+
+	if err := os.MkdirAll(hooksDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(hookPath, []byte(managedHookScript(hook)), 0755)
+}
+
+// uninstallHook removes a managed hook, restoring any chained user hook
+// that install moved aside. A hook install never touched is left alone.
+func uninstallHook(hooksDir, hook string) error {
+	hookPath := path.Join(hooksDir, hook)
+	localPath := hookPath + ".local"
+
+	existing, err := os.ReadFile(hookPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !isManagedHook(existing) {
+		return nil
+	}
+	if err := os.Remove(hookPath); err != nil {
+		return err
+	}
+	if _, err := os.Stat(localPath); err == nil {
+		return os.Rename(localPath, hookPath)
+	}
+	return nil
+}
+
+func isManagedHook(content []byte) bool {
+	return strings.Contains(string(content), hookSentinel)
+}
+
+// managedHookScript generates the shell script installed for hook. The
+// pre-push stage captures git's stdin to a temp file so it can both feed
+// `git preflight run` and forward it unchanged to a chained local hook.
+func managedHookScript(hook string) string {
+	if hook == "pre-push" {
+		// pre-push is invoked as "<remote name> <remote url>", which
+		// are not trigger names: don't forward "$@" to git preflight
+		// run, only to the chained local hook.
+		return fmt.Sprintf(`#!/bin/sh
+%s
+set -e
+stdin_file=$(mktemp)
+trap 'rm -f "$stdin_file"' EXIT
+cat > "$stdin_file"
+git preflight run -hook %s < "$stdin_file"
+if [ -x "$(dirname "$0")/%s.local" ]; then
+  "$(dirname "$0")/%s.local" "$@" < "$stdin_file"
+fi
+`, hookSentinel, hook, hook, hook)
+	}
+	// pre-commit takes no arguments; commit-msg takes the path to the
+	// commit message file. Neither is a trigger name, so only forward
+	// "$@" to the chained local hook, not to git preflight run.
+	return fmt.Sprintf(`#!/bin/sh
+%s
+set -e
+git preflight run -hook %s
+if [ -x "$(dirname "$0")/%s.local" ]; then
+  exec "$(dirname "$0")/%s.local" "$@"
+fi
+`, hookSentinel, hook, hook, hook)
+}
+
+var cmdInstall = &cmdflag.Command{
+	Name:      "install",
+	Run:       runInstall,
+	Args:      cmdflag.PredictNothing,
+	UsageLine: `Install git-preflight as a git hook driver.`,
+	UsageLong: `Install git-preflight as a git hook driver.
+
+  git preflight install
+
+Writes managed pre-commit, pre-push and commit-msg hooks into
+.git/hooks, chaining any hook already there so it still runs afterward.
+Safe to re-run.`,
+}
+
+var cmdUninstall = &cmdflag.Command{
+	Name:      "uninstall",
+	Run:       runUninstall,
+	Args:      cmdflag.PredictNothing,
+	UsageLine: `Remove git-preflight's managed git hooks.`,
+	UsageLong: `Remove git-preflight's managed git hooks.
+
+  git preflight uninstall
+
+Restores any hook that install had chained underneath git-preflight's own.`,
+}
+
 var cmdMain = &cmdflag.Command{
 	Name:      "git-preflight",
 	UsageLong: ``,
@@ -360,6 +1040,8 @@ var cmdMain = &cmdflag.Command{
 var subcommands = []*cmdflag.Command{
 	cmdRun,
 	cmdValidate,
+	cmdInstall,
+	cmdUninstall,
 }
 
 func main() {
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTopoLevels(t *testing.T) {
+	t.Run("declared order within a level", func(t *testing.T) {
+		triggers := []TriggerConfig{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+		levels, err := topoLevels(triggers)
+		if err != nil {
+			t.Fatalf("topoLevels: %v", err)
+		}
+		want := [][]string{{"a", "b", "c"}}
+		if !reflect.DeepEqual(levels, want) {
+			t.Errorf("levels = %v, want %v", levels, want)
+		}
+	})
+
+	t.Run("DependsOn chain", func(t *testing.T) {
+		triggers := []TriggerConfig{
+			{Name: "a", DependsOn: []string{"b"}},
+			{Name: "b", DependsOn: []string{"c"}},
+			{Name: "c"},
+		}
+		levels, err := topoLevels(triggers)
+		if err != nil {
+			t.Fatalf("topoLevels: %v", err)
+		}
+		want := [][]string{{"c"}, {"b"}, {"a"}}
+		if !reflect.DeepEqual(levels, want) {
+			t.Errorf("levels = %v, want %v", levels, want)
+		}
+	})
+
+	t.Run("cycle is an error", func(t *testing.T) {
+		triggers := []TriggerConfig{
+			{Name: "a", DependsOn: []string{"b"}},
+			{Name: "b", DependsOn: []string{"a"}},
+		}
+		if _, err := topoLevels(triggers); err == nil {
+			t.Fatal("expected a cycle error, got nil")
+		}
+	})
+
+	t.Run("dependency outside the set is already satisfied", func(t *testing.T) {
+		triggers := []TriggerConfig{{Name: "a", DependsOn: []string{"missing"}}}
+		levels, err := topoLevels(triggers)
+		if err != nil {
+			t.Fatalf("topoLevels: %v", err)
+		}
+		want := [][]string{{"a"}}
+		if !reflect.DeepEqual(levels, want) {
+			t.Errorf("levels = %v, want %v", levels, want)
+		}
+	})
+}
+
+// TestRunLevelsSerialBarrier reproduces the regression fixed in
+// a91986f: a Serial trigger declared before concurrent ones in the same
+// level must fully complete before any later trigger in that level starts,
+// not run after them.
+func TestRunLevelsSerialBarrier(t *testing.T) {
+	jobsByName := map[string]*triggerJob{
+		"serial1": {tr: &TriggerConfig{Name: "serial1", Serial: true}},
+		"par1":    {tr: &TriggerConfig{Name: "par1"}},
+		"par2":    {tr: &TriggerConfig{Name: "par2"}},
+	}
+	levels := [][]string{{"serial1", "par1", "par2"}}
+
+	var mu sync.Mutex
+	var log []string
+	record := func(s string) {
+		mu.Lock()
+		defer mu.Unlock()
+		log = append(log, s)
+	}
+
+	runOne := func(job *triggerJob) {
+		switch job.tr.Name {
+		case "serial1":
+			time.Sleep(20 * time.Millisecond)
+			record("serial1-done")
+		default:
+			record(job.tr.Name + "-start")
+		}
+	}
+
+	runLevels(context.Background(), levels, jobsByName, 2, false, runOne, func([]string) {})
+
+	mu.Lock()
+	defer mu.Unlock()
+	serialIdx := -1
+	for i, s := range log {
+		if s == "serial1-done" {
+			serialIdx = i
+		}
+	}
+	if serialIdx != 0 {
+		t.Fatalf("serial1 did not run first; log = %v", log)
+	}
+}
+
+// TestRunLevelsFailFastCancellation verifies that once a job cancels the
+// context (mirroring runOne's failFast behavior in runPreflight), no
+// later level is entered.
+func TestRunLevelsFailFastCancellation(t *testing.T) {
+	jobsByName := map[string]*triggerJob{
+		"bad":    {tr: &TriggerConfig{Name: "bad"}},
+		"later1": {tr: &TriggerConfig{Name: "later1"}},
+		"later2": {tr: &TriggerConfig{Name: "later2"}},
+	}
+	levels := [][]string{{"bad"}, {"later1"}, {"later2"}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var log []string
+	runOne := func(job *triggerJob) {
+		mu.Lock()
+		log = append(log, job.tr.Name)
+		mu.Unlock()
+		if job.tr.Name == "bad" {
+			cancel()
+		}
+	}
+
+	runLevels(ctx, levels, jobsByName, 1, true, runOne, func([]string) {})
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"bad"}
+	if !reflect.DeepEqual(log, want) {
+		t.Errorf("log = %v, want %v", log, want)
+	}
+}
+
+func TestInstallUninstallHook(t *testing.T) {
+	const hook = "pre-commit"
+
+	readFile := func(t *testing.T, p string) string {
+		t.Helper()
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatalf("reading %s: %v", p, err)
+		}
+		return string(b)
+	}
+
+	t.Run("fresh install", func(t *testing.T) {
+		hooksDir := t.TempDir()
+		if err := installHook(hooksDir, hook); err != nil {
+			t.Fatalf("installHook: %v", err)
+		}
+		content := readFile(t, filepath.Join(hooksDir, hook))
+		if !isManagedHook([]byte(content)) {
+			t.Errorf("installed hook is not recognized as managed: %s", content)
+		}
+		if _, err := os.Stat(filepath.Join(hooksDir, hook+".local")); !os.IsNotExist(err) {
+			t.Errorf("unexpected %s.local after a fresh install: err=%v", hook, err)
+		}
+	})
+
+	t.Run("reinstall over an already-managed hook", func(t *testing.T) {
+		hooksDir := t.TempDir()
+		if err := installHook(hooksDir, hook); err != nil {
+			t.Fatalf("installHook (1st): %v", err)
+		}
+		if err := installHook(hooksDir, hook); err != nil {
+			t.Fatalf("installHook (2nd): %v", err)
+		}
+		content := readFile(t, filepath.Join(hooksDir, hook))
+		if !isManagedHook([]byte(content)) {
+			t.Errorf("hook is not recognized as managed after reinstall: %s", content)
+		}
+		if _, err := os.Stat(filepath.Join(hooksDir, hook+".local")); !os.IsNotExist(err) {
+			t.Errorf("reinstalling over a managed hook should not create %s.local: err=%v", hook, err)
+		}
+	})
+
+	t.Run("install over an unmanaged hook chains it to .local", func(t *testing.T) {
+		hooksDir := t.TempDir()
+		hookPath := filepath.Join(hooksDir, hook)
+		if err := os.MkdirAll(hooksDir, 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		const userScript = "#!/bin/sh\necho user hook\n"
+		if err := os.WriteFile(hookPath, []byte(userScript), 0755); err != nil {
+			t.Fatalf("writing unmanaged hook: %v", err)
+		}
+
+		if err := installHook(hooksDir, hook); err != nil {
+			t.Fatalf("installHook: %v", err)
+		}
+
+		if got := readFile(t, hookPath); !isManagedHook([]byte(got)) {
+			t.Errorf("hook at %s is not managed after install: %s", hookPath, got)
+		}
+		if got := readFile(t, hookPath+".local"); got != userScript {
+			t.Errorf("chained .local hook = %q, want %q", got, userScript)
+		}
+	})
+
+	t.Run("install refuses to clobber when .local is already taken", func(t *testing.T) {
+		hooksDir := t.TempDir()
+		hookPath := filepath.Join(hooksDir, hook)
+		if err := os.MkdirAll(hooksDir, 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		const userScript = "#!/bin/sh\necho user hook\n"
+		const otherLocal = "#!/bin/sh\necho pre-existing local\n"
+		if err := os.WriteFile(hookPath, []byte(userScript), 0755); err != nil {
+			t.Fatalf("writing unmanaged hook: %v", err)
+		}
+		if err := os.WriteFile(hookPath+".local", []byte(otherLocal), 0755); err != nil {
+			t.Fatalf("writing .local: %v", err)
+		}
+
+		if err := installHook(hooksDir, hook); err == nil {
+			t.Fatal("expected installHook to refuse to clobber, got nil error")
+		}
+
+		if got := readFile(t, hookPath); got != userScript {
+			t.Errorf("unmanaged hook was modified: got %q, want %q", got, userScript)
+		}
+		if got := readFile(t, hookPath+".local"); got != otherLocal {
+			t.Errorf(".local hook was modified: got %q, want %q", got, otherLocal)
+		}
+	})
+
+	t.Run("uninstall restores the chained .local hook", func(t *testing.T) {
+		hooksDir := t.TempDir()
+		hookPath := filepath.Join(hooksDir, hook)
+		if err := os.MkdirAll(hooksDir, 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		const userScript = "#!/bin/sh\necho user hook\n"
+		if err := os.WriteFile(hookPath, []byte(userScript), 0755); err != nil {
+			t.Fatalf("writing unmanaged hook: %v", err)
+		}
+		if err := installHook(hooksDir, hook); err != nil {
+			t.Fatalf("installHook: %v", err)
+		}
+
+		if err := uninstallHook(hooksDir, hook); err != nil {
+			t.Fatalf("uninstallHook: %v", err)
+		}
+
+		if got := readFile(t, hookPath); got != userScript {
+			t.Errorf("hook after uninstall = %q, want restored %q", got, userScript)
+		}
+		if _, err := os.Stat(hookPath + ".local"); !os.IsNotExist(err) {
+			t.Errorf("expected %s.local to be gone after uninstall: err=%v", hook, err)
+		}
+	})
+
+	t.Run("uninstall leaves an untouched hook alone", func(t *testing.T) {
+		hooksDir := t.TempDir()
+		hookPath := filepath.Join(hooksDir, hook)
+		if err := os.MkdirAll(hooksDir, 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		const userScript = "#!/bin/sh\necho user hook\n"
+		if err := os.WriteFile(hookPath, []byte(userScript), 0755); err != nil {
+			t.Fatalf("writing unmanaged hook: %v", err)
+		}
+
+		if err := uninstallHook(hooksDir, hook); err != nil {
+			t.Fatalf("uninstallHook: %v", err)
+		}
+
+		if got := readFile(t, hookPath); got != userScript {
+			t.Errorf("untouched hook was modified: got %q, want %q", got, userScript)
+		}
+	})
+}
+
+func TestManagedHookScriptDoesNotForwardArgsToPreflightRun(t *testing.T) {
+	for _, hook := range []string{"pre-commit", "pre-push", "commit-msg"} {
+		t.Run(hook, func(t *testing.T) {
+			script := managedHookScript(hook)
+			if !isManagedHook([]byte(script)) {
+				t.Errorf("generated script for %s is missing the sentinel", hook)
+			}
+			runLine := fmt.Sprintf("git preflight run -hook %s", hook)
+			if !strings.Contains(script, runLine) {
+				t.Errorf("script for %s does not contain %q:\n%s", hook, runLine, script)
+			}
+			if strings.Contains(script, runLine+` "$@"`) {
+				t.Errorf("script for %s forwards \"$@\" to git preflight run, which breaks on git's own hook args:\n%s", hook, script)
+			}
+		})
+	}
+}
+
+func TestBatchFnames(t *testing.T) {
+	tests := []struct {
+		name   string
+		fnames []string
+		batch  int
+		want   [][]string
+	}{
+		{"no batch", []string{"a", "b", "c"}, 0, [][]string{{"a", "b", "c"}}},
+		{"batch larger than input", []string{"a", "b"}, 5, [][]string{{"a", "b"}}},
+		{"even split", []string{"a", "b", "c", "d"}, 2, [][]string{{"a", "b"}, {"c", "d"}}},
+		{"uneven split", []string{"a", "b", "c"}, 2, [][]string{{"a", "b"}, {"c"}}},
+		{"empty input", []string{}, 2, [][]string{{}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := batchFnames(tc.fnames, tc.batch)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("batchFnames(%v, %d) = %v, want %v", tc.fnames, tc.batch, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunBatchArgs(t *testing.T) {
+	tr := &TriggerConfig{Name: "t", Cmd: []string{"sh", "-c", "echo \"$@\"", "--"}, InputType: InputTypeArgs}
+	var out bytes.Buffer
+	if err := runBatch(context.Background(), ".", tr, []string{"a.go", "b.go"}, &out); err != nil {
+		t.Fatalf("runBatch: %v", err)
+	}
+	if got, want := out.String(), "a.go b.go\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
+
+func TestRunBatchStdin(t *testing.T) {
+	tr := &TriggerConfig{Name: "t", Cmd: []string{"cat"}, InputType: InputTypeStdin}
+	var out bytes.Buffer
+	if err := runBatch(context.Background(), ".", tr, []string{"a.go", "b.go"}, &out); err != nil {
+		t.Fatalf("runBatch: %v", err)
+	}
+	if got, want := out.String(), "a.go\nb.go\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
+
+func TestRunBatchArgfile(t *testing.T) {
+	tr := &TriggerConfig{Name: "t", Cmd: []string{"cat", "{argfile}"}, InputType: InputTypeArgfile}
+	var out bytes.Buffer
+	if err := runBatch(context.Background(), ".", tr, []string{"a.go", "b.go"}, &out); err != nil {
+		t.Fatalf("runBatch: %v", err)
+	}
+	if got, want := out.String(), "a.go\nb.go\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
+
+func TestMatchPatterns(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		fname    string
+		want     bool
+	}{
+		{"vendor glob matches nested file", []string{"**/vendor/**"}, "pkg/vendor/lib/a.go", true},
+		{"vendor glob matches file at repo root", []string{"**/vendor/**"}, "vendor/a.go", true},
+		{"vendor glob excludes unrelated file", []string{"**/vendor/**"}, "pkg/lib/a.go", false},
+		{"negated pattern re-excludes a vendored file", []string{"**/vendor/**", "!important.go"}, "vendor/important.go", false},
+		{"negated pattern does not affect other files", []string{"**/vendor/**", "!important.go"}, "vendor/a.go", true},
+		{"anchored pattern matches only at repo root", []string{"/cmd/*.go"}, "cmd/git-preflight.go", true},
+		{"anchored pattern does not match nested dir", []string{"/cmd/*.go"}, "pkg/cmd/git-preflight.go", false},
+		{"anchored pattern does not cross a path segment", []string{"/cmd/*.go"}, "cmd/sub/git-preflight.go", false},
+		{"no pattern matches by default", []string{"/cmd/*.go"}, "other.go", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := &TriggerConfig{Name: "t", InputType: InputTypeArgs, Patterns: tc.patterns}
+			if err := validateTrigger(tr); err != nil {
+				t.Fatalf("validateTrigger: %v", err)
+			}
+			got, err := match(tr, tc.fname)
+			if err != nil {
+				t.Fatalf("match: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("match(%v, %q) = %v, want %v", tc.patterns, tc.fname, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateTriggerArgfileRequiresPlaceholder(t *testing.T) {
+	tr := &TriggerConfig{Name: "t", Cmd: []string{"gofmt", "-l"}, InputType: InputTypeArgfile}
+	if err := validateTrigger(tr); err == nil {
+		t.Fatal("expected an error for an argfile trigger with no {argfile} placeholder")
+	}
+}
+
+// TestRunPreflightBatchesLargeChangesets drives batchFnames and runBatch
+// together, the way runPreflight runs a trigger's batches, through a temp
+// workdir; it does not call runPreflight or need a real git checkout.
+func TestRunPreflightBatchesLargeChangesets(t *testing.T) {
+	dir := t.TempDir()
+	outPath := filepath.Join(dir, "out.txt")
+	tr := &TriggerConfig{
+		Name:      "t",
+		Cmd:       []string{"sh", "-c", "echo \"$@\" >> " + outPath, "--"},
+		InputType: InputTypeArgs,
+		Batch:     2,
+	}
+	batches := batchFnames([]string{"a", "b", "c", "d", "e"}, tr.Batch)
+	if len(batches) != 3 {
+		t.Fatalf("got %d batches, want 3", len(batches))
+	}
+	var out bytes.Buffer
+	for _, b := range batches {
+		if err := runBatch(context.Background(), dir, tr, b, &out); err != nil {
+			t.Fatalf("runBatch: %v", err)
+		}
+	}
+	got, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatalf("reading batch output: %v", err)
+	}
+	if want := "a b\nc d\ne\n"; string(got) != want {
+		t.Errorf("batch output = %q, want %q", string(got), want)
+	}
+}
@@ -0,0 +1,159 @@
+package gitapi
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ChangeSpec describes which changes ResolveChanges should resolve to a
+// ChangeSet. Exactly one mode applies, chosen in this precedence:
+// Rev, then Staged, then Unstaged, then the default working tree mode.
+type ChangeSpec struct {
+	// Rev is a revision range (A..B or A...B) or a single commit.
+	Rev string
+	// Staged resolves only the staged (index) changes.
+	Staged bool
+	// Unstaged resolves only the unstaged working tree changes.
+	Unstaged bool
+	// WorkingTree resolves staged+unstaged+committed-since-merge-base
+	// changes. This is the default when no other mode is set.
+	WorkingTree bool
+}
+
+// FileChange describes a single changed path. OldName is non-empty when
+// the file was renamed or copied from OldName (git diff -M/-C).
+type FileChange struct {
+	Name    string
+	OldName string
+}
+
+// ChangeSet is the set of files and directories resolved from a ChangeSpec.
+type ChangeSet struct {
+	Files []FileChange
+	Dirs  []string
+}
+
+// FileNames returns the current names of every changed file, sorted.
+func (cs ChangeSet) FileNames() []string {
+	names := make([]string, 0, len(cs.Files))
+	for _, f := range cs.Files {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ResolveChanges resolves spec against the repository rooted at workdir
+// into a ChangeSet, with rename/copy detection (git diff -M).
+func ResolveChanges(workdir string, spec ChangeSpec) (ChangeSet, error) {
+	var (
+		files []FileChange
+		err   error
+	)
+	switch {
+	case spec.Rev != "":
+		files, err = revChanges(workdir, spec.Rev)
+	case spec.Staged:
+		files, err = stagedChanges(workdir)
+	case spec.Unstaged:
+		files, err = unstagedChanges(workdir)
+	default:
+		files, err = workingTreeChanges(workdir)
+	}
+	if err != nil {
+		return ChangeSet{}, err
+	}
+
+	return ChangeSet{
+		Files: files,
+		Dirs:  changedDirs(workdir, files),
+	}, nil
+}
+
+// workingTreeChanges mirrors git-preflight's historical default: every
+// file committed since the merge base, plus unstaged and staged changes.
+// A single-rev `git diff <mergeBase>` already diffs against the working
+// tree, so it already includes staged and unstaged changes; no further
+// diffs are needed.
+func workingTreeChanges(workdir string) ([]FileChange, error) {
+	mergeBaseHash, err := GetMergeBaseCommitHash(workdir)
+	if err != nil {
+		return nil, err
+	}
+	return diffNameStatus(workdir, mergeBaseHash)
+}
+
+func stagedChanges(workdir string) ([]FileChange, error) {
+	return diffNameStatus(workdir, "--cached")
+}
+
+func unstagedChanges(workdir string) ([]FileChange, error) {
+	return diffNameStatus(workdir)
+}
+
+// revChanges resolves a single commit or an A..B / A...B range.
+func revChanges(workdir, rev string) ([]FileChange, error) {
+	if strings.Contains(rev, "..") {
+		return diffNameStatus(workdir, rev)
+	}
+	// A single commit diffs against its first parent, like `git show`.
+	return diffNameStatus(workdir, rev+"^", rev)
+}
+
+// diffNameStatus runs `git diff -M -C --name-status <extraArgs...>` in
+// workdir and parses the result, including rename/copy pairs.
+func diffNameStatus(workdir string, extraArgs ...string) ([]FileChange, error) {
+	args := append([]string{"diff", "--no-color", "-M", "-C", "--name-status"}, extraArgs...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = workdir
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %w", strings.Join(args, " "), err)
+	}
+	return parseNameStatus(string(out))
+}
+
+func parseNameStatus(out string) ([]FileChange, error) {
+	var changes []FileChange
+	for _, line := range strings.Split(out, "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		switch status := fields[0]; {
+		case strings.HasPrefix(status, "R"), strings.HasPrefix(status, "C"):
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("malformed diff --name-status line: %q", line)
+			}
+			changes = append(changes, FileChange{Name: fields[2], OldName: fields[1]})
+		default:
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("malformed diff --name-status line: %q", line)
+			}
+			changes = append(changes, FileChange{Name: fields[1]})
+		}
+	}
+	return changes, nil
+}
+
+// changedDirs returns the sorted, deduplicated set of directories (relative
+// to workdir) that contain a changed file and still exist on disk.
+func changedDirs(workdir string, files []FileChange) []string {
+	dirSet := make(map[string]bool, len(files))
+	for _, f := range files {
+		dirName := path.Dir(f.Name)
+		if fi, err := os.Stat(path.Join(workdir, dirName)); err == nil && fi.IsDir() {
+			dirSet[dirName] = true
+		}
+	}
+	dirs := make([]string, 0, len(dirSet))
+	for d := range dirSet {
+		dirs = append(dirs, d)
+	}
+	sort.Strings(dirs)
+	return dirs
+}